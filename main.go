@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/html"
 )
@@ -32,6 +40,15 @@ func retryImmediately[T any](f func() (*T, error), maxRetryCount int) (*T, error
 	return nil, errs[len(errs)-1], errs
 }
 
+type unexpectedStatusCodeError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *unexpectedStatusCodeError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s", e.StatusCode, e.Url)
+}
+
 func getHtmlWithBasicAuth(url string, user string, pass string) (*html.Node, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -46,9 +63,17 @@ func getHtmlWithBasicAuth(url string, user string, pass string) (*html.Node, err
 	}
 	defer resp.Body.Close()
 
+	// This applies to AP pages as well as the controller page,
+	// so that an error page is not mistaken for a page lacking the expected elements.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &unexpectedStatusCodeError{Url: url, StatusCode: resp.StatusCode}
+	}
+
+	// The body may be cut off mid-stream (e.g. io.ErrUnexpectedEOF or a connection reset).
+	// Callers retry every error returned from here, so this is retried just like a failed request.
 	bytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read response body from %s: %w", url, err)
 	}
 
 	return html.Parse(strings.NewReader(string(bytes)))
@@ -62,6 +87,19 @@ func htmlNodeChildren(node *html.Node) []*html.Node {
 	return children
 }
 
+// concatenates all text nodes under the node, so that text wrapped in e.g. <span> or <b> is included
+func htmlNodeTextContent(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+
+	var builder strings.Builder
+	for _, child := range htmlNodeChildren(node) {
+		builder.WriteString(htmlNodeTextContent(child))
+	}
+	return builder.String()
+}
+
 func findFirstHtmlNodeIncludingSelfSatisfyingPredicate(n *html.Node, predicate func(*html.Node) bool) *html.Node {
 	if predicate(n) {
 		return n
@@ -93,6 +131,18 @@ type EnvVars struct {
 	VirtualControllerVIP     string
 	VirtualControllerGUIUser string
 	VirtualControllerGUIPass string
+	IncludeControllerLabel   bool
+	// zero if scraping should happen on each request instead of in background
+	BackgroundScrapeInterval time.Duration
+	// port put into targets returned from /sd
+	ServiceDiscoveryTargetPort int
+	// paths tried in order when the controller returns 404 for the primary path
+	ControllerPathFallbacks []string
+	EnableDebugEndpoints    bool
+	// how long to wait for in-flight requests and background scrapes on shutdown
+	ShutdownGracePeriod time.Duration
+	// respond to /metrics with 200 and exporter's own metrics even if the scrape failed entirely
+	MetricsAlwaysOk bool
 }
 
 type AccessPointReadFromControllerGUI struct {
@@ -139,21 +189,61 @@ func extractApListDataFromScriptText(script string) ([]AccessPointReadFromContro
 
 	aps := make([]AccessPointReadFromControllerGUI, len(data))
 	for i, apData := range data {
+		if len(apData) <= 7 {
+			return nil, fmt.Errorf("AP entry at index %d has too few fields", i)
+		}
+		hostName, ok := apData[7].(string)
+		if !ok {
+			return nil, fmt.Errorf("AP entry at index %d has non-string hostname", i)
+		}
+
+		// a missing or malformed address is not an error here; such an AP is reported as unaddressable later
+		var ipAddress string
+		if len(apData) > 13 {
+			ipAddress, _ = apData[13].(string)
+		}
+
 		aps[i] = AccessPointReadFromControllerGUI{
-			HostName:  apData[7].(string),
-			IpAddress: apData[13].(string),
+			HostName:  hostName,
+			IpAddress: ipAddress,
 		}
 	}
 
 	return aps, nil
 }
 
+const primaryControllerPath = "/top-virtual-controller.html"
+
+// Fetches the controller top page, trying each of env.ControllerPathFallbacks in order if the primary path 404s.
+func fetchControllerTopHtml(env EnvVars) (*html.Node, error) {
+	paths := append([]string{primaryControllerPath}, env.ControllerPathFallbacks...)
+	for i, path := range paths {
+		topHtmlNode, err := getHtmlWithBasicAuth(
+			fmt.Sprintf("http://%s%s", env.VirtualControllerVIP, path),
+			env.VirtualControllerGUIUser,
+			env.VirtualControllerGUIPass,
+		)
+
+		var statusCodeErr *unexpectedStatusCodeError
+		if errors.As(err, &statusCodeErr) && statusCodeErr.StatusCode == http.StatusNotFound && i < len(paths)-1 {
+			slog.Info(fmt.Sprintf("controller returned 404 for %s, trying %s", path, paths[i+1]))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if path != primaryControllerPath {
+			slog.Info(fmt.Sprintf("fetched controller top page from fallback path %s", path))
+		}
+		return topHtmlNode, nil
+	}
+
+	panic("unreachable: paths always contains the primary path")
+}
+
 func fetchAllAccessPointsFromController(env EnvVars) ([]AccessPointReadFromControllerGUI, error) {
-	topHtmlNode, err := getHtmlWithBasicAuth(
-		fmt.Sprintf("http://%s/top-virtual-controller.html", env.VirtualControllerVIP),
-		env.VirtualControllerGUIUser,
-		env.VirtualControllerGUIPass,
-	)
+	topHtmlNode, err := fetchControllerTopHtml(env)
 	if err != nil {
 		return nil, err
 	}
@@ -167,9 +257,17 @@ func fetchAllAccessPointsFromController(env EnvVars) ([]AccessPointReadFromContr
 	return extractApListDataFromScriptText(*script)
 }
 
+// host part of a URL pointing at the IP address, with IPv6 addresses enclosed in brackets
+func urlHostForIpAddress(ipAddress string) string {
+	if strings.Contains(ipAddress, ":") {
+		return "[" + ipAddress + "]"
+	}
+	return ipAddress
+}
+
 func fetchApDetailFromApGUI(env EnvVars, ap AccessPointReadFromControllerGUI) (*AccessPointDetailReadFromTargetApGUI, error) {
 	topHtmlNode, err := getHtmlWithBasicAuth(
-		fmt.Sprintf("http://%s/manage-system.html", ap.IpAddress),
+		fmt.Sprintf("http://%s/manage-system.html", urlHostForIpAddress(ap.IpAddress)),
 		env.VirtualControllerGUIUser,
 		env.VirtualControllerGUIPass,
 	)
@@ -177,6 +275,10 @@ func fetchApDetailFromApGUI(env EnvVars, ap AccessPointReadFromControllerGUI) (*
 		return nil, err
 	}
 
+	return parseApDetailFromApGUIHtml(topHtmlNode)
+}
+
+func parseApDetailFromApGUIHtml(topHtmlNode *html.Node) (*AccessPointDetailReadFromTargetApGUI, error) {
 	active2_4GhzConnections, err := func() (int, error) {
 		tableRow := findFirstHtmlNodeWithIdIn(topHtmlNode, "2G_connect_count_form")
 		if tableRow == nil {
@@ -187,7 +289,7 @@ func fetchApDetailFromApGUI(env EnvVars, ap AccessPointReadFromControllerGUI) (*
 			return 0, fmt.Errorf("child of node at index 4 expected")
 		}
 
-		return strconv.Atoi(extractNumber.FindString(countDataNode[3].FirstChild.Data))
+		return strconv.Atoi(extractNumber.FindString(htmlNodeTextContent(countDataNode[3])))
 	}()
 	if err != nil {
 		return nil, fmt.Errorf("failed to find 2GHz connection count: %w", err)
@@ -203,7 +305,7 @@ func fetchApDetailFromApGUI(env EnvVars, ap AccessPointReadFromControllerGUI) (*
 			return 0, fmt.Errorf("child of node at index 4 expected")
 		}
 
-		return strconv.Atoi(extractNumber.FindString(countDataNode[3].FirstChild.Data))
+		return strconv.Atoi(extractNumber.FindString(htmlNodeTextContent(countDataNode[3])))
 	}()
 	if err != nil {
 		return nil, fmt.Errorf("failed to find 5GHz connection count: %w", err)
@@ -215,7 +317,7 @@ func fetchApDetailFromApGUI(env EnvVars, ap AccessPointReadFromControllerGUI) (*
 	}, nil
 }
 
-func reconstructAllApData(env EnvVars) ([]ReconstructedApData, error) {
+func fetchAllAccessPointsFromControllerWithRetry(env EnvVars) ([]AccessPointReadFromControllerGUI, error) {
 	aps, err, allErrs := retryImmediately(
 		func() (*[]AccessPointReadFromControllerGUI, error) {
 			aps, err := fetchAllAccessPointsFromController(env)
@@ -230,10 +332,44 @@ func reconstructAllApData(env EnvVars) ([]ReconstructedApData, error) {
 		slog.Info(fmt.Sprintf("retried fetching AP info from controller %d times, last error: %s", len(allErrs), allErrs[len(allErrs)-1].Error()))
 	}
 
+	return *aps, nil
+}
+
+func hasValidIpAddress(ap AccessPointReadFromControllerGUI) bool {
+	return net.ParseIP(ap.IpAddress) != nil
+}
+
+func reconstructAllApData(env EnvVars) (
+	[]ReconstructedApData,
+	[]AccessPointReadFromControllerGUI, /* APs without a valid address */
+	[]AccessPointReadFromControllerGUI, /* APs whose details could not be fetched */
+	error,
+) {
+	aps, err := fetchAllAccessPointsFromControllerWithRetry(env)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// APs without a valid address cannot be queried for details, so set them aside
+	addressableAps := []AccessPointReadFromControllerGUI{}
+	unaddressableAps := []AccessPointReadFromControllerGUI{}
+	for _, ap := range aps {
+		if hasValidIpAddress(ap) {
+			addressableAps = append(addressableAps, ap)
+		} else {
+			slog.Warn(fmt.Sprintf("AP %s has no valid IP address (got %q)", ap.HostName, ap.IpAddress))
+			unaddressableAps = append(unaddressableAps, ap)
+		}
+	}
+
 	// fan-out fetching details and then join all.
-	// This process may fail, in which case nil must be communicated.
-	reconstructedApDataChan := make(chan *ReconstructedApData)
-	for _, ap := range *aps {
+	// This process may fail, in which case nil detail must be communicated.
+	type apDetailResult struct {
+		ap     AccessPointReadFromControllerGUI
+		detail *AccessPointDetailReadFromTargetApGUI
+	}
+	apDetailResultChan := make(chan apDetailResult)
+	for _, ap := range addressableAps {
 		go func() {
 			detail, err, allErrs := retryImmediately(
 				func() (*AccessPointDetailReadFromTargetApGUI, error) { return fetchApDetailFromApGUI(env, ap) },
@@ -241,42 +377,165 @@ func reconstructAllApData(env EnvVars) ([]ReconstructedApData, error) {
 			)
 			if err != nil {
 				slog.Warn(fmt.Sprintf("error fetching detail for %s: error after %d retries: %v", ap.HostName, len(allErrs), err))
-				reconstructedApDataChan <- nil
+				apDetailResultChan <- apDetailResult{ap: ap, detail: nil}
 				return
 			}
 			if len(allErrs) > 0 {
 				slog.Info(fmt.Sprintf("retried fetching detail for %s %d times, last error: %v", ap.HostName, len(allErrs), allErrs[len(allErrs)-1]))
 			}
-			reconstructedApDataChan <- &ReconstructedApData{
-				AccessPointReadFromControllerGUI:     ap,
-				AccessPointDetailReadFromTargetApGUI: *detail,
-			}
+			apDetailResultChan <- apDetailResult{ap: ap, detail: detail}
 		}()
 	}
 
 	reconstructedAps := []ReconstructedApData{}
-	for _, ap := range *aps {
-		reconstructedApData := <-reconstructedApDataChan
-		if reconstructedApData == nil {
-			slog.Warn(fmt.Sprintf("No details obtained for %s", ap.HostName))
+	detailFetchFailedAps := []AccessPointReadFromControllerGUI{}
+	for range addressableAps {
+		result := <-apDetailResultChan
+		if result.detail == nil {
+			slog.Warn(fmt.Sprintf("No details obtained for %s", result.ap.HostName))
+			detailFetchFailedAps = append(detailFetchFailedAps, result.ap)
 			continue
 		}
 
-		reconstructedAps = append(reconstructedAps, *reconstructedApData)
+		reconstructedAps = append(reconstructedAps, ReconstructedApData{
+			AccessPointReadFromControllerGUI:     result.ap,
+			AccessPointDetailReadFromTargetApGUI: *result.detail,
+		})
 	}
 
-	return reconstructedAps, nil
+	return reconstructedAps, unaddressableAps, detailFetchFailedAps, nil
+}
+
+type scrapeSnapshot struct {
+	Aps              []ReconstructedApData
+	UnaddressableAps []AccessPointReadFromControllerGUI
+	// APs listed by the controller whose details could not be fetched
+	DetailFetchFailedAps []AccessPointReadFromControllerGUI
+	Err                  error
+	ScrapedAt            time.Time
+}
+
+// State shared between the scrape path and the handlers
+type scrapeState struct {
+	// The result of the most recent scrape.
+	// This is swapped as a whole so that readers never observe a partially updated result.
+	latestSnapshot atomic.Pointer[scrapeSnapshot]
+	// number of scrapes that failed to obtain the AP list from the controller, exposed as wlx_scrape_errors_total
+	errorsTotal atomic.Uint64
+	// whether runBackgroundScrapes is in the middle of a scrape
+	backgroundScrapeInProgress atomic.Bool
+}
+
+func scrapeIntoLatestSnapshot(env EnvVars, state *scrapeState) *scrapeSnapshot {
+	aps, unaddressableAps, detailFetchFailedAps, err := reconstructAllApData(env)
+	if err != nil {
+		state.errorsTotal.Add(1)
+	}
+	snapshot := &scrapeSnapshot{
+		Aps:                  aps,
+		UnaddressableAps:     unaddressableAps,
+		DetailFetchFailedAps: detailFetchFailedAps,
+		Err:                  err,
+		ScrapedAt:            time.Now(),
+	}
+	state.latestSnapshot.Store(snapshot)
+	return snapshot
+}
+
+// Scrapes periodically until ctx is cancelled.
+// A scrape that is in progress when ctx is cancelled is completed before returning,
+// so that the latest snapshot is never left half-written.
+func runBackgroundScrapes(ctx context.Context, env EnvVars, state *scrapeState) {
+	ticker := time.NewTicker(env.BackgroundScrapeInterval)
+	defer ticker.Stop()
+	for {
+		// checked here as well because select below picks ticker.C at random when both are ready
+		if ctx.Err() != nil {
+			return
+		}
+
+		state.backgroundScrapeInProgress.Store(true)
+		scrapeIntoLatestSnapshot(env, state)
+		state.backgroundScrapeInProgress.Store(false)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the snapshot a request should be served from.
+// When background scraping is enabled, this reads the latest snapshot without doing any I/O.
+func snapshotForRequest(env EnvVars, state *scrapeState) (*scrapeSnapshot, error) {
+	if env.BackgroundScrapeInterval <= 0 {
+		snapshot := scrapeIntoLatestSnapshot(env, state)
+		return snapshot, snapshot.Err
+	}
+
+	snapshot := state.latestSnapshot.Load()
+	if snapshot == nil {
+		return nil, fmt.Errorf("no background scrape has completed yet")
+	}
+	return snapshot, snapshot.Err
+}
+
+// summary of the latest snapshot, published via expvar on /debug/vars
+func latestScrapeSnapshotDebugVar(state *scrapeState) any {
+	snapshot := state.latestSnapshot.Load()
+	if snapshot == nil {
+		return nil
+	}
+
+	apStatuses := map[string]any{}
+	for _, ap := range snapshot.Aps {
+		apStatuses[ap.HostName] = map[string]any{
+			"status":                    "ok",
+			"ip_address":                ap.IpAddress,
+			"active_2_4ghz_connections": ap.Active2_4GHzConnections,
+			"active_5ghz_connections":   ap.Active5GHzConnections,
+		}
+	}
+	for _, ap := range snapshot.UnaddressableAps {
+		apStatuses[ap.HostName] = map[string]any{
+			"status":     "unaddressable",
+			"ip_address": ap.IpAddress,
+		}
+	}
+	for _, ap := range snapshot.DetailFetchFailedAps {
+		apStatuses[ap.HostName] = map[string]any{
+			"status":     "detail_fetch_failed",
+			"ip_address": ap.IpAddress,
+		}
+	}
+
+	var scrapeError *string
+	if snapshot.Err != nil {
+		message := snapshot.Err.Error()
+		scrapeError = &message
+	}
+
+	return map[string]any{
+		"scraped_at":                   snapshot.ScrapedAt,
+		"error":                        scrapeError,
+		"ap_count":                     len(snapshot.Aps),
+		"unaddressable_ap_count":       len(snapshot.UnaddressableAps),
+		"detail_fetch_failed_ap_count": len(snapshot.DetailFetchFailedAps),
+		"ap_statuses_by_hostname":      apStatuses,
+	}
 }
 
 // return fetchAllAccessPoints as a JSON response
-func aplist(env EnvVars, w http.ResponseWriter, _ *http.Request) {
+func aplist(env EnvVars, state *scrapeState, w http.ResponseWriter, _ *http.Request) {
 	// fetch all access points
-	aps, err := reconstructAllApData(env)
+	snapshot, err := snapshotForRequest(env, state)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("error fetching access points: %v", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	aps := snapshot.Aps
 
 	// write the response
 	w.Header().Set("Content-Type", "application/json")
@@ -287,15 +546,85 @@ func aplist(env EnvVars, w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-func metrics(env EnvVars, w http.ResponseWriter, _ *http.Request) {
-	// fetch all access points
-	aps, err := reconstructAllApData(env)
+// A target group in the format expected by Prometheus' HTTP service discovery
+type httpSdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// APs in the snapshot that have a valid address, whether or not their details could be fetched
+func addressableApsInSnapshot(snapshot *scrapeSnapshot) []AccessPointReadFromControllerGUI {
+	aps := []AccessPointReadFromControllerGUI{}
+	for _, ap := range snapshot.Aps {
+		aps = append(aps, ap.AccessPointReadFromControllerGUI)
+	}
+	return append(aps, snapshot.DetailFetchFailedAps...)
+}
+
+// return APs listed by the controller as a Prometheus HTTP SD response
+func sd(env EnvVars, state *scrapeState, w http.ResponseWriter, _ *http.Request) {
+	// With background scraping enabled, serve from the latest snapshot so that this does not block on the controller.
+	// Otherwise only the AP list is fetched, as a full scrape would also query every AP.
+	var aps []AccessPointReadFromControllerGUI
+	var err error
+	if env.BackgroundScrapeInterval > 0 {
+		var snapshot *scrapeSnapshot
+		if snapshot, err = snapshotForRequest(env, state); err == nil {
+			aps = addressableApsInSnapshot(snapshot)
+		}
+	} else {
+		aps, err = fetchAllAccessPointsFromControllerWithRetry(env)
+	}
 	if err != nil {
 		slog.Warn(fmt.Sprintf("error fetching access points: %v", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	targetGroups := []httpSdTargetGroup{}
+	for _, ap := range aps {
+		if !hasValidIpAddress(ap) {
+			continue
+		}
+
+		labels := map[string]string{"hostname": ap.HostName}
+		if env.IncludeControllerLabel {
+			labels["controller"] = env.VirtualControllerVIP
+		}
+		targetGroups = append(targetGroups, httpSdTargetGroup{
+			Targets: []string{net.JoinHostPort(ap.IpAddress, strconv.Itoa(env.ServiceDiscoveryTargetPort))},
+			Labels:  labels,
+		})
+	}
+
+	// write the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(targetGroups); err != nil {
+		slog.Warn(fmt.Sprintf("error encoding service discovery targets: %v", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func metrics(env EnvVars, state *scrapeState, w http.ResponseWriter, _ *http.Request) {
+	// fetch all access points
+	snapshot, err := snapshotForRequest(env, state)
+	scrapeSucceeded := err == nil
+	if !scrapeSucceeded {
+		slog.Warn(fmt.Sprintf("error fetching access points: %v", err))
+		if !env.MetricsAlwaysOk {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var aps []ReconstructedApData
+	var unaddressableAps []AccessPointReadFromControllerGUI
+	var detailFetchFailedAps []AccessPointReadFromControllerGUI
+	if scrapeSucceeded {
+		aps, unaddressableAps, detailFetchFailedAps = snapshot.Aps, snapshot.UnaddressableAps, snapshot.DetailFetchFailedAps
+	}
+
 	appendLineToResponse := func(line string) error {
 		if _, err := w.Write([]byte(line + "\n")); err != nil {
 			slog.Error(fmt.Sprintf("error writing access points: %v", err))
@@ -305,18 +634,73 @@ func metrics(env EnvVars, w http.ResponseWriter, _ *http.Request) {
 		return nil
 	}
 
+	// labels identifying the AP, shared by all AP metrics
+	apLabels := func(hostName string) string {
+		if env.IncludeControllerLabel {
+			return fmt.Sprintf("hostname=\"%s\",controller=\"%s\"", hostName, env.VirtualControllerVIP)
+		}
+		return fmt.Sprintf("hostname=\"%s\"", hostName)
+	}
+
 	// write the response
 	w.Header().Set("Content-Type", "text/plain")
+	up := 0
+	if scrapeSucceeded {
+		up = 1
+	}
+	if err = appendLineToResponse(fmt.Sprintf("wlx_up %d", up)); err != nil {
+		return
+	}
+	if err = appendLineToResponse(fmt.Sprintf("wlx_scrape_errors_total %d", state.errorsTotal.Load())); err != nil {
+		return
+	}
 	for _, ap := range aps {
-		if err = appendLineToResponse(fmt.Sprintf("ap_active_connections{hostname=\"%s\",frequency=\"2.4GHz\"} %d", ap.HostName, ap.Active2_4GHzConnections)); err != nil {
+		if err = appendLineToResponse(fmt.Sprintf("wlx_ap_up{%s} 1", apLabels(ap.HostName))); err != nil {
+			return
+		}
+		if err = appendLineToResponse(fmt.Sprintf("ap_active_connections{%s,frequency=\"2.4GHz\"} %d", apLabels(ap.HostName), ap.Active2_4GHzConnections)); err != nil {
 			return
 		}
-		if err = appendLineToResponse(fmt.Sprintf("ap_active_connections{hostname=\"%s\",frequency=\"5GHz\"} %d", ap.HostName, ap.Active5GHzConnections)); err != nil {
+		if err = appendLineToResponse(fmt.Sprintf("ap_active_connections{%s,frequency=\"5GHz\"} %d", apLabels(ap.HostName), ap.Active5GHzConnections)); err != nil {
+			return
+		}
+	}
+	// addressable APs whose details could not be fetched are reported as down, as opposed to unaddressable
+	for _, ap := range detailFetchFailedAps {
+		if err = appendLineToResponse(fmt.Sprintf("wlx_ap_up{%s} 0", apLabels(ap.HostName))); err != nil {
+			return
+		}
+	}
+	for _, ap := range unaddressableAps {
+		if err = appendLineToResponse(fmt.Sprintf("wlx_ap_unaddressable{%s} 1", apLabels(ap.HostName))); err != nil {
 			return
 		}
 	}
 }
 
+// Shuts the server down and waits for background scrapes to finish, both within the grace period.
+// Returns whether background scrapes finished before the grace period ran out.
+func shutdown(server *http.Server, backgroundScrapesDone <-chan struct{}, state *scrapeState, gracePeriod time.Duration) bool {
+	slog.Info("Shutting down...", "grace_period", gracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("error shutting down server", "error", err.Error())
+	}
+
+	if state.backgroundScrapeInProgress.Load() {
+		slog.Info("Waiting for in-flight background scrape to finish...")
+	}
+	select {
+	case <-backgroundScrapesDone:
+		return true
+	case <-shutdownCtx.Done():
+		slog.Warn("gave up waiting for in-flight background scrape after grace period")
+		return false
+	}
+}
+
 func requireNonEmptyEnv(key string) string {
 	envVar := os.Getenv(key)
 	if envVar == "" {
@@ -326,6 +710,42 @@ func requireNonEmptyEnv(key string) string {
 	return envVar
 }
 
+func optionalBoolEnv(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func optionalPathListEnv(key string) []string {
+	paths := []string{}
+	for _, path := range strings.Split(os.Getenv(key), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func optionalIntEnv(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func optionalDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
 func main() {
 	slog.Info("Reading environment variables...")
 
@@ -337,20 +757,65 @@ func main() {
 	}
 
 	env := EnvVars{
-		VirtualControllerVIP:     requireNonEmptyEnv("VIRTUAL_CONTROLLER_VIP"),
-		VirtualControllerGUIUser: requireNonEmptyEnv("VIRTUAL_CONTROLLER_GUI_USER"),
-		VirtualControllerGUIPass: requireNonEmptyEnv("VIRTUAL_CONTROLLER_GUI_PASS"),
+		VirtualControllerVIP:       requireNonEmptyEnv("VIRTUAL_CONTROLLER_VIP"),
+		VirtualControllerGUIUser:   requireNonEmptyEnv("VIRTUAL_CONTROLLER_GUI_USER"),
+		VirtualControllerGUIPass:   requireNonEmptyEnv("VIRTUAL_CONTROLLER_GUI_PASS"),
+		IncludeControllerLabel:     optionalBoolEnv("INCLUDE_CONTROLLER_LABEL", false),
+		BackgroundScrapeInterval:   optionalDurationEnv("BACKGROUND_SCRAPE_INTERVAL", 0),
+		ServiceDiscoveryTargetPort: optionalIntEnv("SD_TARGET_PORT", 80),
+		ControllerPathFallbacks:    optionalPathListEnv("CONTROLLER_PATH_FALLBACKS"),
+		EnableDebugEndpoints:       optionalBoolEnv("ENABLE_DEBUG_ENDPOINTS", false),
+		ShutdownGracePeriod:        optionalDurationEnv("SHUTDOWN_GRACE_PERIOD", 10*time.Second),
+		MetricsAlwaysOk:            optionalBoolEnv("METRICS_ALWAYS_OK", false),
 	}
 
-	http.HandleFunc("/aplist", func(w http.ResponseWriter, r *http.Request) {
-		aplist(env, w, r)
+	state := &scrapeState{}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backgroundScrapesDone := make(chan struct{})
+	if env.BackgroundScrapeInterval > 0 {
+		slog.Info("Starting background scrapes...", "interval", env.BackgroundScrapeInterval)
+		go func() {
+			defer close(backgroundScrapesDone)
+			runBackgroundScrapes(ctx, env, state)
+		}()
+	} else {
+		close(backgroundScrapesDone)
+	}
+
+	// importing expvar registers /debug/vars on http.DefaultServeMux, so use a dedicated mux to keep it opt-in
+	mux := http.NewServeMux()
+	mux.HandleFunc("/aplist", func(w http.ResponseWriter, r *http.Request) {
+		aplist(env, state, w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics(env, state, w, r)
 	})
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics(env, w, r)
+	mux.HandleFunc("/sd", func(w http.ResponseWriter, r *http.Request) {
+		sd(env, state, w, r)
 	})
+	if env.EnableDebugEndpoints {
+		expvar.Publish("wlx_latest_scrape", expvar.Func(func() any { return latestScrapeSnapshotDebugVar(state) }))
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
 
+	server := &http.Server{Addr: ":" + strconv.Itoa(serverPort), Handler: mux}
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.ListenAndServe()
+	}()
 	slog.Info("Starting server...", "port", serverPort)
-	if err := http.ListenAndServe(":"+strconv.Itoa(serverPort), nil); err != nil {
+
+	select {
+	case err := <-serverErrChan:
 		slog.Error("error starting server", "error", err.Error())
+		return
+	case <-ctx.Done():
 	}
+	// restore the default signal behaviour so that a second signal can force an exit during the drain
+	stop()
+
+	shutdown(server, backgroundScrapesDone, state, env.ShutdownGracePeriod)
 }
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// starts a server that counts requests made to it, delegating them to handler
+func newCountingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &hits
+}
+
+func serverHost(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func serveMetrics(env EnvVars, state *scrapeState) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	metrics(env, state, recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder
+}
+
+func TestMetricsWithBackgroundScrapingDoesNoIO(t *testing.T) {
+	controller, hits := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	env := EnvVars{
+		VirtualControllerVIP:     serverHost(controller),
+		BackgroundScrapeInterval: time.Minute,
+	}
+
+	state := &scrapeState{}
+	state.latestSnapshot.Store(&scrapeSnapshot{
+		Aps: []ReconstructedApData{{
+			AccessPointReadFromControllerGUI:     AccessPointReadFromControllerGUI{HostName: "ap-01", IpAddress: "192.168.0.11"},
+			AccessPointDetailReadFromTargetApGUI: AccessPointDetailReadFromTargetApGUI{Active2_4GHzConnections: 3, Active5GHzConnections: 7},
+		}},
+		ScrapedAt: time.Now(),
+	})
+
+	response := serveMetrics(env, state)
+
+	if hits.Load() != 0 {
+		t.Errorf("expected no requests to the controller, got %d", hits.Load())
+	}
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", response.Code)
+	}
+	if !strings.Contains(response.Body.String(), `ap_active_connections{hostname="ap-01",frequency="5GHz"} 7`) {
+		t.Errorf("expected metrics from the stored snapshot, got:\n%s", response.Body.String())
+	}
+}
+
+func TestMetricsControllerLabel(t *testing.T) {
+	newState := func() *scrapeState {
+		state := &scrapeState{}
+		state.latestSnapshot.Store(&scrapeSnapshot{
+			Aps: []ReconstructedApData{{
+				AccessPointReadFromControllerGUI:     AccessPointReadFromControllerGUI{HostName: "ap-01", IpAddress: "192.168.0.11"},
+				AccessPointDetailReadFromTargetApGUI: AccessPointDetailReadFromTargetApGUI{Active2_4GHzConnections: 3, Active5GHzConnections: 7},
+			}},
+			ScrapedAt: time.Now(),
+		})
+		return state
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		env := EnvVars{VirtualControllerVIP: "192.168.0.1", BackgroundScrapeInterval: time.Minute, IncludeControllerLabel: true}
+		body := serveMetrics(env, newState()).Body.String()
+
+		for _, expected := range []string{
+			`ap_active_connections{hostname="ap-01",controller="192.168.0.1",frequency="2.4GHz"} 3`,
+			`ap_active_connections{hostname="ap-01",controller="192.168.0.1",frequency="5GHz"} 7`,
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("expected %q in:\n%s", expected, body)
+			}
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		env := EnvVars{VirtualControllerVIP: "192.168.0.1", BackgroundScrapeInterval: time.Minute}
+		body := serveMetrics(env, newState()).Body.String()
+
+		if strings.Contains(body, "controller=") {
+			t.Errorf("expected no controller label in:\n%s", body)
+		}
+		if !strings.Contains(body, `ap_active_connections{hostname="ap-01",frequency="2.4GHz"} 3`) {
+			t.Errorf("expected unlabelled AP metric in:\n%s", body)
+		}
+	})
+}
+
+// a row of apListData with the hostname at index 7 and the IP address at index 13
+func apListDataRow(hostName string, ipAddress string) string {
+	return fmt.Sprintf(`[0,0,0,0,0,0,0,%q,0,0,0,0,0,%q]`, hostName, ipAddress)
+}
+
+func apListDataScript(rows ...string) string {
+	return fmt.Sprintf("<html><body><script>var apListData=[%s,];</script></body></html>", strings.Join(rows, ","))
+}
+
+func TestExtractApListDataKeepsApsWithInvalidIpAddress(t *testing.T) {
+	script := fmt.Sprintf("var apListData=[%s,%s,];", apListDataRow("ap-01", "192.168.0.11"), apListDataRow("ap-02", "not-an-ip"))
+
+	aps, err := extractApListDataFromScriptText(script)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []AccessPointReadFromControllerGUI{
+		{HostName: "ap-01", IpAddress: "192.168.0.11"},
+		{HostName: "ap-02", IpAddress: "not-an-ip"},
+	}
+	if !reflect.DeepEqual(aps, expected) {
+		t.Fatalf("expected %v, got %v", expected, aps)
+	}
+	if !hasValidIpAddress(aps[0]) {
+		t.Errorf("expected %q to be a valid address", aps[0].IpAddress)
+	}
+	if hasValidIpAddress(aps[1]) {
+		t.Errorf("expected %q to be an invalid address", aps[1].IpAddress)
+	}
+}
+
+func TestMetricsReportsUnaddressableAps(t *testing.T) {
+	t.Run("from the controller list", func(t *testing.T) {
+		controller, _ := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, apListDataScript(apListDataRow("ap-01", "not-an-ip"), apListDataRow("ap-02", "")))
+		})
+		env := EnvVars{VirtualControllerVIP: serverHost(controller)}
+
+		response := serveMetrics(env, &scrapeState{})
+
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", response.Code)
+		}
+		for _, expected := range []string{
+			`wlx_ap_unaddressable{hostname="ap-01"} 1`,
+			`wlx_ap_unaddressable{hostname="ap-02"} 1`,
+		} {
+			if !strings.Contains(response.Body.String(), expected) {
+				t.Errorf("expected %q in:\n%s", expected, response.Body.String())
+			}
+		}
+	})
+
+	t.Run("distinguishes unaddressable APs from unreachable ones", func(t *testing.T) {
+		env := EnvVars{VirtualControllerVIP: "192.168.0.1", BackgroundScrapeInterval: time.Minute}
+		state := &scrapeState{}
+		state.latestSnapshot.Store(&scrapeSnapshot{
+			Aps: []ReconstructedApData{{
+				AccessPointReadFromControllerGUI: AccessPointReadFromControllerGUI{HostName: "ap-01", IpAddress: "192.168.0.11"},
+			}},
+			UnaddressableAps:     []AccessPointReadFromControllerGUI{{HostName: "ap-02", IpAddress: "not-an-ip"}},
+			DetailFetchFailedAps: []AccessPointReadFromControllerGUI{{HostName: "ap-03", IpAddress: "192.168.0.13"}},
+			ScrapedAt:            time.Now(),
+		})
+
+		body := serveMetrics(env, state).Body.String()
+
+		for _, expected := range []string{
+			`wlx_ap_up{hostname="ap-01"} 1`,
+			`wlx_ap_up{hostname="ap-03"} 0`,
+			`wlx_ap_unaddressable{hostname="ap-02"} 1`,
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("expected %q in:\n%s", expected, body)
+			}
+		}
+		if strings.Contains(body, `wlx_ap_up{hostname="ap-02"}`) {
+			t.Errorf("expected no wlx_ap_up for the unaddressable AP in:\n%s", body)
+		}
+	})
+}
+
+func TestUrlHostForIpAddress(t *testing.T) {
+	for ipAddress, expected := range map[string]string{
+		"192.168.0.11": "192.168.0.11",
+		"fe80::1":      "[fe80::1]",
+	} {
+		if actual := urlHostForIpAddress(ipAddress); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, ipAddress, actual)
+		}
+	}
+}
+
+func TestSdReturnsAddressableApsAsTargetGroups(t *testing.T) {
+	controller, _ := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, apListDataScript(
+			apListDataRow("ap-01", "192.168.0.11"),
+			apListDataRow("ap-02", "not-an-ip"),
+			apListDataRow("ap-03", "192.168.0.13"),
+		))
+	})
+	env := EnvVars{
+		VirtualControllerVIP:       serverHost(controller),
+		ServiceDiscoveryTargetPort: 9100,
+	}
+
+	recorder := httptest.NewRecorder()
+	sd(env, &scrapeState{}, recorder, httptest.NewRequest(http.MethodGet, "/sd", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", contentType)
+	}
+
+	var actual any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("response is not valid JSON: %v\n%s", err, recorder.Body.String())
+	}
+	var expected any
+	if err := json.Unmarshal([]byte(`[
+		{"targets":["192.168.0.11:9100"],"labels":{"hostname":"ap-01"}},
+		{"targets":["192.168.0.13:9100"],"labels":{"hostname":"ap-03"}}
+	]`), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestSdWithBackgroundScrapingServesFromSnapshot(t *testing.T) {
+	controller, hits := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	env := EnvVars{
+		VirtualControllerVIP:       serverHost(controller),
+		BackgroundScrapeInterval:   time.Minute,
+		ServiceDiscoveryTargetPort: 80,
+	}
+	state := &scrapeState{}
+	state.latestSnapshot.Store(&scrapeSnapshot{
+		Aps: []ReconstructedApData{{
+			AccessPointReadFromControllerGUI: AccessPointReadFromControllerGUI{HostName: "ap-01", IpAddress: "192.168.0.11"},
+		}},
+		UnaddressableAps:     []AccessPointReadFromControllerGUI{{HostName: "ap-02", IpAddress: "not-an-ip"}},
+		DetailFetchFailedAps: []AccessPointReadFromControllerGUI{{HostName: "ap-03", IpAddress: "192.168.0.13"}},
+		ScrapedAt:            time.Now(),
+	})
+
+	recorder := httptest.NewRecorder()
+	sd(env, state, recorder, httptest.NewRequest(http.MethodGet, "/sd", nil))
+
+	if hits.Load() != 0 {
+		t.Errorf("expected no requests to the controller, got %d", hits.Load())
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+
+	var actual []httpSdTargetGroup
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("response is not valid JSON: %v\n%s", err, recorder.Body.String())
+	}
+	expected := []httpSdTargetGroup{
+		{Targets: []string{"192.168.0.11:80"}, Labels: map[string]string{"hostname": "ap-01"}},
+		{Targets: []string{"192.168.0.13:80"}, Labels: map[string]string{"hostname": "ap-03"}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestParseApDetailReadsCountsInsideNestedElements(t *testing.T) {
+	topHtmlNode, err := html.Parse(strings.NewReader(`<html><body><table>
+<tr id="2G_connect_count_form">
+<td>2.4GHz</td>
+<td><span><b>12</b> clients</span></td>
+</tr>
+<tr id="5G1_connect_count_form">
+<td>5GHz</td>
+<td>3</td>
+</tr>
+</table></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err := parseApDetailFromApGUIHtml(topHtmlNode)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := AccessPointDetailReadFromTargetApGUI{Active2_4GHzConnections: 12, Active5GHzConnections: 3}
+	if *detail != expected {
+		t.Errorf("expected %+v, got %+v", expected, *detail)
+	}
+}
+
+func TestFetchAllAccessPointsIsRetriedAfterBodyIsCutOff(t *testing.T) {
+	body := apListDataScript(apListDataRow("ap-01", "192.168.0.11"))
+	var firstRequestServed atomic.Bool
+
+	controller, hits := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		if !firstRequestServed.Swap(true) {
+			// declare the full length but close the connection after sending only a part of the body
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("failed to hijack connection: %v", err)
+				return
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:len(body)/2])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, body)
+	})
+	env := EnvVars{VirtualControllerVIP: serverHost(controller)}
+
+	aps, err, allErrs := retryImmediately(
+		func() (*[]AccessPointReadFromControllerGUI, error) {
+			aps, err := fetchAllAccessPointsFromController(env)
+			return &aps, err
+		},
+		3,
+	)
+
+	if err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if len(allErrs) != 1 || !errors.Is(allErrs[0], io.ErrUnexpectedEOF) {
+		t.Errorf("expected exactly one io.ErrUnexpectedEOF before success, got %v", allErrs)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected 2 requests to the controller, got %d", hits.Load())
+	}
+	expected := []AccessPointReadFromControllerGUI{{HostName: "ap-01", IpAddress: "192.168.0.11"}}
+	if !reflect.DeepEqual(*aps, expected) {
+		t.Errorf("expected %v, got %v", expected, *aps)
+	}
+}
+
+func TestFetchAllAccessPointsFallsBackWhenPrimaryPath404s(t *testing.T) {
+	var requestedPaths []string
+	controller, _ := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requestedPaths = append(requestedPaths, r.URL.Path)
+		if r.URL.Path != "/top-virtual-controller.html/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, apListDataScript(apListDataRow("ap-01", "192.168.0.11")))
+	})
+
+	t.Run("fallback succeeds", func(t *testing.T) {
+		requestedPaths = nil
+		env := EnvVars{
+			VirtualControllerVIP:    serverHost(controller),
+			ControllerPathFallbacks: []string{"/index.html", "/top-virtual-controller.html/", "/"},
+		}
+
+		aps, err := fetchAllAccessPointsFromController(env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []AccessPointReadFromControllerGUI{{HostName: "ap-01", IpAddress: "192.168.0.11"}}
+		if !reflect.DeepEqual(aps, expected) {
+			t.Errorf("expected %v, got %v", expected, aps)
+		}
+		expectedPaths := []string{"/top-virtual-controller.html", "/index.html", "/top-virtual-controller.html/"}
+		if !reflect.DeepEqual(requestedPaths, expectedPaths) {
+			t.Errorf("expected paths %v to be requested, got %v", expectedPaths, requestedPaths)
+		}
+	})
+
+	t.Run("no fallbacks", func(t *testing.T) {
+		requestedPaths = nil
+		env := EnvVars{VirtualControllerVIP: serverHost(controller)}
+
+		_, err := fetchAllAccessPointsFromController(env)
+
+		var statusCodeErr *unexpectedStatusCodeError
+		if !errors.As(err, &statusCodeErr) || statusCodeErr.StatusCode != http.StatusNotFound {
+			t.Errorf("expected a 404 error, got %v", err)
+		}
+	})
+}
+
+func TestLatestScrapeSnapshotDebugVarReportsEveryApStatus(t *testing.T) {
+	state := &scrapeState{}
+	state.latestSnapshot.Store(&scrapeSnapshot{
+		Aps: []ReconstructedApData{{
+			AccessPointReadFromControllerGUI: AccessPointReadFromControllerGUI{HostName: "ap-01", IpAddress: "192.168.0.11"},
+		}},
+		UnaddressableAps:     []AccessPointReadFromControllerGUI{{HostName: "ap-02", IpAddress: ""}},
+		DetailFetchFailedAps: []AccessPointReadFromControllerGUI{{HostName: "ap-03", IpAddress: "192.168.0.13"}},
+		ScrapedAt:            time.Now(),
+	})
+
+	debugVar := latestScrapeSnapshotDebugVar(state).(map[string]any)
+	apStatuses := debugVar["ap_statuses_by_hostname"].(map[string]any)
+
+	for hostName, expectedStatus := range map[string]string{
+		"ap-01": "ok",
+		"ap-02": "unaddressable",
+		"ap-03": "detail_fetch_failed",
+	} {
+		apStatus, ok := apStatuses[hostName].(map[string]any)
+		if !ok {
+			t.Errorf("expected a status for %s, got %v", hostName, apStatuses)
+			continue
+		}
+		if apStatus["status"] != expectedStatus {
+			t.Errorf("expected status %q for %s, got %v", expectedStatus, hostName, apStatus["status"])
+		}
+	}
+	if debugVar["detail_fetch_failed_ap_count"] != 1 {
+		t.Errorf("expected detail_fetch_failed_ap_count 1, got %v", debugVar["detail_fetch_failed_ap_count"])
+	}
+}
+
+func TestRunBackgroundScrapesCompletesInFlightScrapeOnCancel(t *testing.T) {
+	scrapeStarted := make(chan struct{}, 1)
+	releaseScrape := make(chan struct{})
+	controller, hits := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		scrapeStarted <- struct{}{}
+		<-releaseScrape
+		fmt.Fprint(w, apListDataScript(apListDataRow("ap-01", "not-an-ip")))
+	})
+	// a short interval so that the ticker is ready by the time the scrape completes
+	env := EnvVars{VirtualControllerVIP: serverHost(controller), BackgroundScrapeInterval: time.Millisecond}
+	state := &scrapeState{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runBackgroundScrapes(ctx, env, state)
+	}()
+
+	<-scrapeStarted
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatal("runBackgroundScrapes returned before the in-flight scrape completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !state.backgroundScrapeInProgress.Load() {
+		t.Error("expected a background scrape to be reported as in progress")
+	}
+
+	close(releaseScrape)
+	<-done
+
+	snapshot := state.latestSnapshot.Load()
+	if snapshot == nil {
+		t.Fatal("expected the in-flight scrape to be stored before returning")
+	}
+	if snapshot.Err != nil || len(snapshot.UnaddressableAps) != 1 {
+		t.Errorf("expected a complete snapshot, got %+v", snapshot)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected no scrape to start after cancellation, got %d requests", hits.Load())
+	}
+}
+
+// captures logs written through slog's default logger for the duration of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var logs bytes.Buffer
+	previousLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previousLogger) })
+
+	return &logs
+}
+
+func TestShutdownDrainsInFlightBackgroundScrape(t *testing.T) {
+	// Starts background scrapes whose first scrape blocks until release is called, and waits until that scrape has started.
+	// The returned channel is closed when runBackgroundScrapes returns after ctx is cancelled.
+	startBlockedBackgroundScrape := func(t *testing.T) (*scrapeState, <-chan struct{}, func()) {
+		scrapeStarted := make(chan struct{}, 1)
+		releaseScrape := make(chan struct{})
+		controller, _ := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+			scrapeStarted <- struct{}{}
+			<-releaseScrape
+			fmt.Fprint(w, apListDataScript(apListDataRow("ap-01", "not-an-ip")))
+		})
+		env := EnvVars{VirtualControllerVIP: serverHost(controller), BackgroundScrapeInterval: time.Minute}
+		state := &scrapeState{}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runBackgroundScrapes(ctx, env, state)
+		}()
+
+		<-scrapeStarted
+		cancel()
+		return state, done, func() { close(releaseScrape) }
+	}
+
+	t.Run("scrape finishes within grace period", func(t *testing.T) {
+		logs := captureLogs(t)
+		state, done, release := startBlockedBackgroundScrape(t)
+
+		time.AfterFunc(50*time.Millisecond, release)
+		drained := shutdown(&http.Server{}, done, state, 5*time.Second)
+
+		if !drained {
+			t.Error("expected the background scrape to be drained")
+		}
+		if snapshot := state.latestSnapshot.Load(); snapshot == nil || len(snapshot.UnaddressableAps) != 1 {
+			t.Errorf("expected the in-flight scrape to be stored, got %+v", snapshot)
+		}
+		if !strings.Contains(logs.String(), "Waiting for in-flight background scrape to finish") {
+			t.Errorf("expected waiting to be logged, got:\n%s", logs.String())
+		}
+	})
+
+	t.Run("grace period runs out first", func(t *testing.T) {
+		logs := captureLogs(t)
+		state, done, release := startBlockedBackgroundScrape(t)
+
+		drained := shutdown(&http.Server{}, done, state, 50*time.Millisecond)
+		release()
+		<-done
+
+		if drained {
+			t.Error("expected shutdown to give up on the background scrape")
+		}
+		for _, expected := range []string{
+			"Waiting for in-flight background scrape to finish",
+			"gave up waiting for in-flight background scrape after grace period",
+		} {
+			if !strings.Contains(logs.String(), expected) {
+				t.Errorf("expected %q to be logged, got:\n%s", expected, logs.String())
+			}
+		}
+	})
+}
+
+func TestMetricsWhenControllerFailsEntirely(t *testing.T) {
+	controller, _ := newCountingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	t.Run("responds 500 by default", func(t *testing.T) {
+		env := EnvVars{VirtualControllerVIP: serverHost(controller)}
+
+		response := serveMetrics(env, &scrapeState{})
+
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", response.Code)
+		}
+	})
+
+	t.Run("responds 200 with exporter metrics when METRICS_ALWAYS_OK", func(t *testing.T) {
+		env := EnvVars{VirtualControllerVIP: serverHost(controller), MetricsAlwaysOk: true}
+		state := &scrapeState{}
+
+		for scrapeCount := 1; scrapeCount <= 2; scrapeCount++ {
+			response := serveMetrics(env, state)
+
+			if response.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d", response.Code)
+			}
+			expected := fmt.Sprintf("wlx_up 0\nwlx_scrape_errors_total %d\n", scrapeCount)
+			if response.Body.String() != expected {
+				t.Errorf("expected body %q, got %q", expected, response.Body.String())
+			}
+		}
+	})
+}